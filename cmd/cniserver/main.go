@@ -0,0 +1,43 @@
+// Command cniserver is the long-running daemon behind cnishim. It owns the
+// IpPool, bridge, and veth state in memory and serves ADD/DEL/CHECK/VERSION
+// over a Unix domain socket so cnishim invocations don't pay the cost of
+// reloading state from disk on every call.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TheRealSibasishBehera/cni-basic/pkg/server"
+)
+
+func main() {
+	socketPath := flag.String("socket", server.DefaultSocketPath, "path to the Unix domain socket to listen on")
+	flag.Parse()
+
+	srv := server.New(*socketPath)
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("cniserver listening on %s", *socketPath)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			log.Fatalf("cniserver: %v", err)
+		}
+	case sig := <-sigCh:
+		log.Printf("cniserver shutting down on %s", sig)
+		if err := srv.Shutdown(); err != nil {
+			log.Fatalf("cniserver: shutdown: %v", err)
+		}
+	}
+}
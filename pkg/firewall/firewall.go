@@ -0,0 +1,138 @@
+// Package firewall installs the iptables rules a bridge network needs to
+// reach the outside world and, optionally, to isolate containers from each
+// other — the same shape of rules the libnetwork bridge driver sets up.
+package firewall
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+// Config describes one network's firewall setup. Chain names are derived
+// from Bridge so multiple pools on the same host don't step on each other.
+type Config struct {
+	Bridge string // bridge interface name, e.g. cni0
+	CIDR   string // pool CIDR that MASQUERADE applies to
+	IPMasq bool   // install the POSTROUTING MASQUERADE rule
+	ICC    bool   // allow inter-container communication across the bridge
+	Path   string // directory the refcount file lives in, alongside the IP pool
+}
+
+func (c Config) masqChain() string {
+	return fmt.Sprintf("CNI-MASQ-%s", c.Bridge)
+}
+
+// Setup installs this network's iptables rules the first time a container
+// joins it, and just bumps the refcount on every later call.
+func Setup(cfg Config) error {
+	count, err := newRefcountStore(cfg.Path).increment(cfg.Bridge)
+	if err != nil {
+		return err
+	}
+	if count > 1 {
+		return nil
+	}
+	return installRules(cfg)
+}
+
+// Teardown decrements the refcount for this network and removes its
+// iptables rules once the last container has left.
+func Teardown(cfg Config) error {
+	count, err := newRefcountStore(cfg.Path).decrement(cfg.Bridge)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	return removeRules(cfg)
+}
+
+func installRules(cfg Config) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %v", err)
+	}
+
+	if cfg.IPMasq {
+		exists, err := ipt.ChainExists("nat", cfg.masqChain())
+		if err != nil {
+			return fmt.Errorf("failed to check for chain %s: %v", cfg.masqChain(), err)
+		}
+		if !exists {
+			if err := ipt.NewChain("nat", cfg.masqChain()); err != nil {
+				return fmt.Errorf("failed to create chain %s: %v", cfg.masqChain(), err)
+			}
+		}
+		if err := ipt.AppendUnique("nat", "POSTROUTING", "-s", cfg.CIDR, "-j", cfg.masqChain()); err != nil {
+			return fmt.Errorf("failed to hook %s into POSTROUTING: %v", cfg.masqChain(), err)
+		}
+		// Traffic destined back into the pool, or leaving via the bridge
+		// itself, shouldn't be masqueraded.
+		if err := ipt.AppendUnique("nat", cfg.masqChain(), "-d", cfg.CIDR, "-j", "RETURN"); err != nil {
+			return fmt.Errorf("failed to add masquerade exclusion in %s: %v", cfg.masqChain(), err)
+		}
+		if err := ipt.AppendUnique("nat", cfg.masqChain(), "-o", cfg.Bridge, "-j", "RETURN"); err != nil {
+			return fmt.Errorf("failed to add bridge exclusion in %s: %v", cfg.masqChain(), err)
+		}
+		if err := ipt.AppendUnique("nat", cfg.masqChain(), "-j", "MASQUERADE"); err != nil {
+			return fmt.Errorf("failed to add MASQUERADE rule to %s: %v", cfg.masqChain(), err)
+		}
+	}
+
+	for _, rule := range forwardRules(cfg) {
+		if err := ipt.AppendUnique("filter", "FORWARD", rule...); err != nil {
+			return fmt.Errorf("failed to install FORWARD rule %v for %s: %v", rule, cfg.Bridge, err)
+		}
+	}
+
+	return nil
+}
+
+// forwardRules returns, in the order they must be installed, the FORWARD
+// chain rules for this network. iptables evaluates FORWARD top-down and
+// stops at the first match, so the ICC DROP rule has to precede the bridge
+// ACCEPT rules below it — otherwise container-to-container traffic (which
+// also matches "-i cni0") is accepted by the looser rule first and the DROP
+// never fires.
+func forwardRules(cfg Config) [][]string {
+	var rules [][]string
+	if !cfg.ICC {
+		rules = append(rules, []string{"-i", cfg.Bridge, "-o", cfg.Bridge, "-j", "DROP"})
+	}
+	rules = append(rules,
+		[]string{"-i", cfg.Bridge, "-j", "ACCEPT"},
+		[]string{"-o", cfg.Bridge, "-j", "ACCEPT"},
+	)
+	return rules
+}
+
+func removeRules(cfg Config) error {
+	ipt, err := iptables.New()
+	if err != nil {
+		return fmt.Errorf("failed to initialize iptables: %v", err)
+	}
+
+	var errs []error
+
+	if cfg.IPMasq {
+		if err := ipt.DeleteIfExists("nat", "POSTROUTING", "-s", cfg.CIDR, "-j", cfg.masqChain()); err != nil {
+			errs = append(errs, err)
+		}
+		if err := ipt.ClearAndDeleteChain("nat", cfg.masqChain()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, rule := range forwardRules(cfg) {
+		if err := ipt.DeleteIfExists("filter", "FORWARD", rule...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove some firewall rules: %v", errs)
+	}
+	return nil
+}
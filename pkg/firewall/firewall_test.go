@@ -0,0 +1,22 @@
+package firewall
+
+import "testing"
+
+func TestForwardRulesDropPrecedesAcceptWhenICCDisabled(t *testing.T) {
+	rules := forwardRules(Config{Bridge: "cni0", ICC: false})
+	if len(rules) == 0 {
+		t.Fatal("expected at least one FORWARD rule")
+	}
+	if got := rules[0][len(rules[0])-1]; got != "DROP" {
+		t.Fatalf("expected the ICC DROP rule to be installed before the ACCEPT rules, got first rule ending in %q", got)
+	}
+}
+
+func TestForwardRulesOmitDropWhenICCEnabled(t *testing.T) {
+	rules := forwardRules(Config{Bridge: "cni0", ICC: true})
+	for _, rule := range rules {
+		if rule[len(rule)-1] == "DROP" {
+			t.Fatalf("did not expect a DROP rule when ICC is enabled, got %v", rule)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// refcount tracks how many containers currently use one network's firewall
+// rules, persisted next to the IP pool file so the count survives a daemon
+// restart.
+type refcount struct {
+	Count int `json:"count"`
+}
+
+type refcountStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func newRefcountStore(path string) *refcountStore {
+	return &refcountStore{path: path}
+}
+
+func (r *refcountStore) file(network string) string {
+	return filepath.Join(r.path, fmt.Sprintf("firewall-%s.json", network))
+}
+
+// increment bumps the refcount for network and returns the new value.
+func (r *refcountStore) increment(network string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rc, err := r.load(network)
+	if err != nil {
+		return 0, err
+	}
+	rc.Count++
+	if err := r.save(network, rc); err != nil {
+		return 0, err
+	}
+	return rc.Count, nil
+}
+
+// decrement drops the refcount for network and returns the new value,
+// removing the refcount file entirely once it reaches zero.
+func (r *refcountStore) decrement(network string) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rc, err := r.load(network)
+	if err != nil {
+		return 0, err
+	}
+	if rc.Count > 0 {
+		rc.Count--
+	}
+	if rc.Count == 0 {
+		if err := os.Remove(r.file(network)); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("failed to remove firewall refcount: %v", err)
+		}
+		return 0, nil
+	}
+	if err := r.save(network, rc); err != nil {
+		return 0, err
+	}
+	return rc.Count, nil
+}
+
+func (r *refcountStore) load(network string) (refcount, error) {
+	data, err := os.ReadFile(r.file(network))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return refcount{}, nil
+		}
+		return refcount{}, fmt.Errorf("failed to read firewall refcount: %v", err)
+	}
+	var rc refcount
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return refcount{}, fmt.Errorf("failed to unmarshal firewall refcount: %v", err)
+	}
+	return rc, nil
+}
+
+func (r *refcountStore) save(network string, rc refcount) error {
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal firewall refcount: %v", err)
+	}
+	if err := os.WriteFile(r.file(network), data, 0644); err != nil {
+		return fmt.Errorf("failed to write firewall refcount: %v", err)
+	}
+	return nil
+}
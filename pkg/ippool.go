@@ -4,135 +4,277 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"sort"
 	"sync"
 )
 
-type IpPool struct {
-	PoolName  string `json:"pool_name"`
-	CidrRange string `json:"cidr_range"`
-	Path      string `json:"path"`
-	Gateway   int    `json:"gateway,omitempty"` //index from the allocation slice and not the actual IP
-
-	TotalIps        int    `json:"total_ips"`
-	LastAllocatedIP int    `json:"last_allocated_ip"`    // index from the Allocation slice and not the actual IP
-	Allocation      []byte `json:"allocation,omitempty"` //allocated IPs in the pool
-	//runtime state
-	mutex sync.Mutex
+// ipRange tracks allocation state for a single CIDR. Offsets are counted
+// from the network's base address as a big.Int rather than a per-address
+// bitmap, so a /64 (or larger) range costs a handful of big.Int words
+// instead of 2^64 bytes. The network address and the first offset (by
+// convention the gateway) are reserved; IPv4 ranges additionally reserve
+// the broadcast address.
+type ipRange struct {
+	CIDR       string     `json:"cidr"`
+	NextOffset *big.Int   `json:"next_offset"`
+	Freed      []*big.Int `json:"freed,omitempty"`
+
+	network    *net.IPNet
+	lastOffset *big.Int
 }
 
-func NewIpPool(poolName, cidrRange, path string) *IpPool {
-	var ipPool IpPool
-	if poolName == "" || cidrRange == "" || path == "" {
-		log.Fatalf("Pool name, CIDR range, and path cannot be empty")
+func newIPRange(cidr string) (*ipRange, error) {
+	r := &ipRange{CIDR: cidr, NextOffset: big.NewInt(2)}
+	if err := r.init(); err != nil {
+		return nil, err
 	}
-	_, ipNet, err := net.ParseCIDR(cidrRange)
+	return r, nil
+}
+
+// init (re)derives the network and the last allocatable offset from CIDR.
+// It's called both right after construction and after Load, since the
+// parsed *net.IPNet isn't itself persisted.
+func (r *ipRange) init() error {
+	_, network, err := net.ParseCIDR(r.CIDR)
 	if err != nil {
-		log.Fatalf("Invalid CIDR range: %s", cidrRange)
+		return fmt.Errorf("invalid CIDR range: %s", r.CIDR)
+	}
+	r.network = network
+
+	ones, bits := network.Mask.Size()
+	total := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	last := new(big.Int).Sub(total, big.NewInt(1)) // last in-range offset (the all-ones address)
+	if network.IP.To4() != nil {
+		last.Sub(last, big.NewInt(1)) // IPv4 additionally reserves the broadcast address
+	}
+	r.lastOffset = last
+
+	if r.NextOffset == nil {
+		r.NextOffset = big.NewInt(2) // 0 = network address, 1 = gateway
+	}
+	return nil
+}
+
+func (r *ipRange) addrAt(offset *big.Int) net.IP {
+	base := new(big.Int).SetBytes(r.network.IP)
+	addr := new(big.Int).Add(base, offset)
+
+	raw := addr.Bytes()
+	ip := make(net.IP, len(r.network.IP))
+	copy(ip[len(ip)-len(raw):], raw)
+	return ip
+}
+
+func (r *ipRange) offsetOf(ip net.IP) (*big.Int, error) {
+	if !r.network.Contains(ip) {
+		return nil, fmt.Errorf("IP %s is not part of range %s", ip, r.CIDR)
+	}
+	size := len(r.network.IP)
+	normalized := ip.To4()
+	if size == net.IPv6len {
+		normalized = ip.To16()
+	}
+	base := new(big.Int).SetBytes(r.network.IP)
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(normalized), base)
+	if offset.Sign() < 0 || offset.Cmp(r.lastOffset) > 0 {
+		return nil, fmt.Errorf("IP %s is out of range for %s", ip, r.CIDR)
+	}
+	return offset, nil
+}
+
+// allocate returns the next address for this range, preferring the lowest
+// previously-released offset over advancing the high-water mark.
+func (r *ipRange) allocate() (net.IP, error) {
+	if len(r.Freed) > 0 {
+		sort.Slice(r.Freed, func(i, j int) bool { return r.Freed[i].Cmp(r.Freed[j]) < 0 })
+		offset := r.Freed[0]
+		r.Freed = r.Freed[1:]
+		return r.addrAt(offset), nil
+	}
+
+	if r.NextOffset.Cmp(r.lastOffset) > 0 {
+		return nil, fmt.Errorf("no available IPs in range %s", r.CIDR)
 	}
-	ipPool.PoolName = poolName
-	ipPool.CidrRange = cidrRange
-	ipPool.Path = path
-	err = os.MkdirAll(path, 0755)
+	offset := new(big.Int).Set(r.NextOffset)
+	r.NextOffset.Add(r.NextOffset, big.NewInt(1))
+	return r.addrAt(offset), nil
+}
+
+// markAllocated records ip as in use without picking a new address,
+// advancing the high-water mark past it if needed. It's idempotent, for
+// restoring a previously assigned address (e.g. on daemon reload).
+func (r *ipRange) markAllocated(ip net.IP) error {
+	offset, err := r.offsetOf(ip)
 	if err != nil {
-		log.Fatalf("Failed to create directory %s: %v", path, err)
+		return err
+	}
+
+	for i, freed := range r.Freed {
+		if freed.Cmp(offset) == 0 {
+			r.Freed = append(r.Freed[:i], r.Freed[i+1:]...)
+			return nil
+		}
 	}
+	if offset.Cmp(r.NextOffset) >= 0 {
+		r.NextOffset = new(big.Int).Add(offset, big.NewInt(1))
+	}
+	return nil
+}
 
-	// total - one for gateway , one for broadcast , one for network address
-	// the gatewat would be used by the cni bridge plugin
-	// representation is like
-	// [0] = 0.2
-	// [1] = 0.3
-	// [2] = 0.4
-	// [3] = 0.5
-	// [4] = 0.6
-	// [5] = 0.7
-	// [6] = 0.8
-	// lets say last allocated is 3
-	// look from 2 to 0
-	//if not free, look from 4 to 255
-	size, _ := ipNet.Mask.Size()
-	ipPool.TotalIps = 1<<uint(size) - 3
+// allocateSpecific reserves ip for a caller that asked for it by address
+// (e.g. a CNI_ARGS IP= hint), unlike markAllocated it errors rather than
+// succeeding if the address is already in use. Offsets between the current
+// high-water mark and ip, if any, are pushed onto Freed so a sparse static
+// allocation doesn't strand them as permanently unavailable.
+func (r *ipRange) allocateSpecific(ip net.IP) error {
+	offset, err := r.offsetOf(ip)
+	if err != nil {
+		return err
+	}
 
-	ipPool.Allocation = make([]byte, ipPool.TotalIps)
-	for i := 0; i < ipPool.TotalIps; i++ {
-		ipPool.Allocation[i] = 0
+	for i, freed := range r.Freed {
+		if freed.Cmp(offset) == 0 {
+			r.Freed = append(r.Freed[:i], r.Freed[i+1:]...)
+			return nil
+		}
 	}
-	return &ipPool
+	if offset.Cmp(r.NextOffset) < 0 {
+		return fmt.Errorf("IP %s is already allocated", ip)
+	}
+	for gap := new(big.Int).Set(r.NextOffset); gap.Cmp(offset) < 0; gap.Add(gap, big.NewInt(1)) {
+		r.Freed = append(r.Freed, new(big.Int).Set(gap))
+	}
+	r.NextOffset = new(big.Int).Add(offset, big.NewInt(1))
+	return nil
 }
 
-func (ipPool *IpPool) AllocateIP() (net.IP, error) {
-	ipPool.mutex.Lock()
-	defer ipPool.mutex.Unlock()
+func (r *ipRange) release(ip net.IP) error {
+	offset, err := r.offsetOf(ip)
+	if err != nil {
+		return err
+	}
+	if offset.Cmp(r.NextOffset) >= 0 {
+		return fmt.Errorf("IP %s is not allocated", ip)
+	}
+	for _, freed := range r.Freed {
+		if freed.Cmp(offset) == 0 {
+			return fmt.Errorf("IP %s is not allocated", ip)
+		}
+	}
+	r.Freed = append(r.Freed, offset)
+	return nil
+}
 
-	if ipPool.LastAllocatedIP >= ipPool.TotalIps {
-		return nil, fmt.Errorf("no more IPs available in the pool")
-	}
-	//reverse search
-	// [0] is .2
-	for i := ipPool.LastAllocatedIP; i >= 0; i-- {
-		if ipPool.Allocation[i] == 0 {
-			ipPool.Allocation[i] = 1
-			// dont update last allocated for reverse search
-			// ipPool.LastAllocatedIP = i
-			ip := net.ParseIP(ipPool.CidrRange).To4()
-			if ip == nil {
-				return nil, fmt.Errorf("invalid CIDR range: %s", ipPool.CidrRange)
-			}
-			ip[3] += byte(i + 1)
-			return ip, nil
+// IpPool hands out addresses from one or more CIDRs (typically one IPv4 and
+// one IPv6 range) to containers on a network.
+type IpPool struct {
+	PoolName string     `json:"pool_name"`
+	Path     string     `json:"path"`
+	Ranges   []*ipRange `json:"ranges"`
+
+	mutex sync.Mutex
+}
+
+// NewIpPool returns a pool over cidrRanges, keyed by poolName and persisted
+// under path.
+func NewIpPool(poolName string, cidrRanges []string, path string) *IpPool {
+	if poolName == "" || len(cidrRanges) == 0 || path == "" {
+		log.Fatalf("pool name, at least one CIDR range, and path are required")
+	}
+
+	ranges := make([]*ipRange, 0, len(cidrRanges))
+	for _, cidr := range cidrRanges {
+		r, err := newIPRange(cidr)
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
+		ranges = append(ranges, r)
 	}
 
-	//forward search
-	for i := ipPool.LastAllocatedIP + 1; i < ipPool.TotalIps; i++ {
-		if ipPool.Allocation[i] == 0 {
-			ipPool.Allocation[i] = 1
-			ipPool.LastAllocatedIP = i
-			ip := net.ParseIP(ipPool.CidrRange).To4()
-			if ip == nil {
-				return nil, fmt.Errorf("invalid CIDR range: %s", ipPool.CidrRange)
-			}
-			ip[3] += byte(i + 1)
-			return ip, nil
+	if err := os.MkdirAll(path, 0755); err != nil {
+		log.Fatalf("failed to create directory %s: %v", path, err)
+	}
+
+	return &IpPool{PoolName: poolName, Path: path, Ranges: ranges}
+}
+
+func (ipPool *IpPool) rangeFor(ip net.IP) (*ipRange, error) {
+	for _, r := range ipPool.Ranges {
+		if r.network.Contains(ip) {
+			return r, nil
 		}
 	}
-	return nil, fmt.Errorf("no available IPs in the pool")
+	return nil, fmt.Errorf("IP %s is not part of any range in pool %s", ip, ipPool.PoolName)
 }
 
-func (ipPool *IpPool) ReleaseIP(ip net.IP) error {
+// AllocateIP draws one address from every range in the pool (so a
+// dual-stack pool returns one IPv4 and one IPv6 address together). If any
+// range is exhausted, addresses already drawn in this call are released
+// before returning the error.
+func (ipPool *IpPool) AllocateIP() ([]net.IP, error) {
 	ipPool.mutex.Lock()
 	defer ipPool.mutex.Unlock()
 
-	if ip == nil {
-		return fmt.Errorf("IP cannot be nil")
+	ips := make([]net.IP, 0, len(ipPool.Ranges))
+	for _, r := range ipPool.Ranges {
+		ip, err := r.allocate()
+		if err != nil {
+			for _, allocated := range ips {
+				if rollback, rerr := ipPool.rangeFor(allocated); rerr == nil {
+					rollback.release(allocated)
+				}
+			}
+			return nil, fmt.Errorf("failed to allocate from range %s: %v", r.CIDR, err)
+		}
+		ips = append(ips, ip)
 	}
+	return ips, nil
+}
 
-	ip4 := ip.To4()
-	if ip4 == nil {
-		return fmt.Errorf("IP is not a valid IPv4 address")
+// MarkAllocated marks ip's offset as allocated without picking a new
+// address. It's used to restore a previously assigned IP (e.g. from the
+// status store on reload) instead of drawing a fresh one from the pool.
+func (ipPool *IpPool) MarkAllocated(ip net.IP) error {
+	ipPool.mutex.Lock()
+	defer ipPool.mutex.Unlock()
+
+	r, err := ipPool.rangeFor(ip)
+	if err != nil {
+		return err
 	}
+	return r.markAllocated(ip)
+}
+
+// AllocateSpecificIP reserves ip for a caller requesting it by address,
+// returning an error if it's already allocated to someone else.
+func (ipPool *IpPool) AllocateSpecificIP(ip net.IP) error {
+	ipPool.mutex.Lock()
+	defer ipPool.mutex.Unlock()
 
-	index := int(ip4[3]) - 1 // convert to index
-	if index < 0 || index >= ipPool.TotalIps {
-		return fmt.Errorf("IP %s is out of range for the pool", ip)
+	r, err := ipPool.rangeFor(ip)
+	if err != nil {
+		return err
 	}
+	return r.allocateSpecific(ip)
+}
 
-	if ipPool.Allocation[index] == 0 {
-		return fmt.Errorf("IP %s is not allocated", ip)
+func (ipPool *IpPool) ReleaseIP(ip net.IP) error {
+	ipPool.mutex.Lock()
+	defer ipPool.mutex.Unlock()
+
+	if ip == nil {
+		return fmt.Errorf("IP cannot be nil")
 	}
 
-	ipPool.Allocation[index] = 0
-	if index == ipPool.LastAllocatedIP {
-		for i := ipPool.LastAllocatedIP - 1; i >= 0; i-- {
-			if ipPool.Allocation[i] == 1 {
-				ipPool.LastAllocatedIP = i
-				break
-			}
-		}
+	r, err := ipPool.rangeFor(ip)
+	if err != nil {
+		return err
 	}
-	return nil
+	return r.release(ip)
 }
 
 func (ipPool *IpPool) Save() error {
@@ -161,5 +303,11 @@ func (ipPool *IpPool) Load() error {
 	if err := json.Unmarshal(data, ipPool); err != nil {
 		return fmt.Errorf("failed to unmarshal IP pool data: %v", err)
 	}
+
+	for _, r := range ipPool.Ranges {
+		if err := r.init(); err != nil {
+			return fmt.Errorf("failed to reload range %s: %v", r.CIDR, err)
+		}
+	}
 	return nil
 }
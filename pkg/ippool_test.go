@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAllocateIPDualStackRoundTrip(t *testing.T) {
+	pool := NewIpPool("test", []string{"10.0.0.0/24", "fd00::/64"}, t.TempDir())
+
+	ips, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP: %v", err)
+	}
+	if len(ips) != 2 {
+		t.Fatalf("expected one address per range, got %d", len(ips))
+	}
+	if ips[0].String() != "10.0.0.2" {
+		t.Errorf("expected first IPv4 address to be 10.0.0.2, got %s", ips[0])
+	}
+	if ips[1].String() != "fd00::2" {
+		t.Errorf("expected first IPv6 address to be fd00::2, got %s", ips[1])
+	}
+
+	for _, ip := range ips {
+		if err := pool.ReleaseIP(ip); err != nil {
+			t.Fatalf("ReleaseIP(%s): %v", ip, err)
+		}
+	}
+
+	again, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP after release: %v", err)
+	}
+	if again[0].String() != ips[0].String() || again[1].String() != ips[1].String() {
+		t.Errorf("expected released addresses to be reused, got %v", again)
+	}
+}
+
+func TestAllocateIPLargePoolDoesNotMaterializeBitmap(t *testing.T) {
+	pool := NewIpPool("test", []string{"2001:db8::/64"}, t.TempDir())
+
+	ips, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP: %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "2001:db8::2" {
+		t.Fatalf("unexpected allocation from a /64 pool: %v", ips)
+	}
+}
+
+func TestMarkAllocatedRejectsUnknownRange(t *testing.T) {
+	pool := NewIpPool("test", []string{"10.0.0.0/24"}, t.TempDir())
+
+	if err := pool.MarkAllocated(net.ParseIP("192.168.1.5")); err == nil {
+		t.Fatal("expected an error marking an IP outside any configured range")
+	}
+}
+
+func TestAllocateIPReservesIPv4Broadcast(t *testing.T) {
+	pool := NewIpPool("test", []string{"10.0.0.0/30"}, t.TempDir())
+
+	// /30 has 4 addresses: .0 (network), .1 (gateway), .2, .3 (broadcast).
+	// Only .2 is allocatable.
+	ips, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP: %v", err)
+	}
+	if ips[0].String() != "10.0.0.2" {
+		t.Fatalf("expected 10.0.0.2, got %s", ips[0])
+	}
+
+	if _, err := pool.AllocateIP(); err == nil {
+		t.Fatal("expected the pool to be exhausted without ever handing out the broadcast address 10.0.0.3")
+	}
+}
+
+func TestAllocateIPStopsAtLastIPv6Address(t *testing.T) {
+	pool := NewIpPool("test", []string{"fd00::/126"}, t.TempDir())
+
+	// /126 has 4 addresses: ::0 (network), ::1 (gateway), ::2, ::3 (last).
+	// There's no broadcast address to additionally reserve in IPv6.
+	ips, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP: %v", err)
+	}
+	if ips[0].String() != "fd00::2" {
+		t.Fatalf("expected fd00::2, got %s", ips[0])
+	}
+
+	second, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP: %v", err)
+	}
+	if second[0].String() != "fd00::3" {
+		t.Fatalf("expected fd00::3, got %s", second[0])
+	}
+
+	if _, err := pool.AllocateIP(); err == nil {
+		t.Fatal("expected the pool to be exhausted without ever handing out fd00::4, which belongs to the next /126")
+	}
+}
+
+func TestAllocateSpecificIPRejectsAlreadyTaken(t *testing.T) {
+	pool := NewIpPool("test", []string{"10.0.0.0/24"}, t.TempDir())
+
+	requested := net.ParseIP("10.0.0.50")
+	if err := pool.AllocateSpecificIP(requested); err != nil {
+		t.Fatalf("AllocateSpecificIP: %v", err)
+	}
+	if err := pool.AllocateSpecificIP(requested); err == nil {
+		t.Fatal("expected an error allocating an already-taken IP")
+	}
+
+	// The gap below the requested offset must still be available to a
+	// normal allocation rather than stranded.
+	ips, err := pool.AllocateIP()
+	if err != nil {
+		t.Fatalf("AllocateIP: %v", err)
+	}
+	if ips[0].String() != "10.0.0.2" {
+		t.Errorf("expected the gap before the static IP to be allocated first, got %s", ips[0])
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import "strings"
+
+// parseCNIArgs parses the semicolon-separated KEY=VAL pairs CNI_ARGS carries
+// per the CNI spec (e.g. "IP=10.0.0.5;K8S_POD_NAME=foo"). Malformed pairs
+// are skipped rather than treated as a hard error, since CNI_ARGS commonly
+// carries keys this plugin doesn't recognize.
+func parseCNIArgs(args string) map[string]string {
+	parsed := make(map[string]string)
+	for _, pair := range strings.Split(args, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		parsed[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return parsed
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultSocketPath is where the daemon listens unless overridden.
+const DefaultSocketPath = "/var/run/cni-basic.sock"
+
+// Client dials the daemon's Unix domain socket and performs one
+// request/response round trip per Call, matching the one-shot nature of a
+// CNI plugin invocation.
+type Client struct {
+	SocketPath string
+	Timeout    time.Duration
+}
+
+// NewClient returns a Client for the given socket path, defaulting to
+// DefaultSocketPath if empty.
+func NewClient(socketPath string) *Client {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Client{SocketPath: socketPath, Timeout: 10 * time.Second}
+}
+
+// Call dials the daemon, sends req, and returns its decoded Response.
+func (c *Client) Call(req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", c.SocketPath, c.dialTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial cni-basic daemon at %s: %v", c.SocketPath, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("failed to send request to daemon: %v", err)
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read response from daemon: %v", err)
+	}
+	return &resp, nil
+}
+
+func (c *Client) dialTimeout() time.Duration {
+	if c.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// delegateMeta is the subset of a delegate's embedded config the daemon
+// needs to read before exec'ing the referenced plugin binary.
+type delegateMeta struct {
+	Type   string `json:"type"`
+	IfName string `json:"ifName,omitempty"`
+}
+
+// delegateRecord is persisted per container so Del can replay the exact
+// delegate invocations from Add without re-reading the top-level config.
+type delegateRecord struct {
+	ContainerID string            `json:"container_id"`
+	Delegates   []json.RawMessage `json:"delegates"`
+}
+
+// delegateStorePath places the per-container delegate record next to the
+// IP pool file.
+func delegateStorePath(path, containerID string) string {
+	return filepath.Join(path, fmt.Sprintf("delegates-%s.json", containerID))
+}
+
+func saveDelegateRecord(path, containerID string, delegates []json.RawMessage) error {
+	record := delegateRecord{ContainerID: containerID, Delegates: delegates}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delegate record: %v", err)
+	}
+	if err := os.WriteFile(delegateStorePath(path, containerID), data, 0644); err != nil {
+		return fmt.Errorf("failed to write delegate record: %v", err)
+	}
+	return nil
+}
+
+func loadDelegateRecord(path, containerID string) (*delegateRecord, error) {
+	data, err := os.ReadFile(delegateStorePath(path, containerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delegate record: %v", err)
+	}
+	var record delegateRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal delegate record: %v", err)
+	}
+	return &record, nil
+}
+
+func removeDelegateRecord(path, containerID string) error {
+	if err := os.Remove(delegateStorePath(path, containerID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove delegate record: %v", err)
+	}
+	return nil
+}
+
+// findDelegateBinary looks up a delegate's plugin type on CNI_PATH.
+func findDelegateBinary(cniPath, pluginType string) (string, error) {
+	for _, dir := range filepath.SplitList(cniPath) {
+		candidate := filepath.Join(dir, pluginType)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find delegate plugin %q in CNI_PATH %q", pluginType, cniPath)
+}
+
+// execDelegate serializes a single delegate config to stdin and execs the
+// referenced plugin binary, mirroring how Multus invokes chained plugins.
+func execDelegate(command string, env Env, raw json.RawMessage) (*CNIResult, error) {
+	var meta delegateMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse delegate config: %v", err)
+	}
+	if meta.Type == "" {
+		return nil, fmt.Errorf("delegate config missing \"type\"")
+	}
+
+	binary, err := findDelegateBinary(env.Path, meta.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	ifName := meta.IfName
+	if ifName == "" {
+		ifName = env.IfName
+	}
+
+	cmd := exec.Command(binary)
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("CNI_COMMAND=%s", command),
+		fmt.Sprintf("CNI_CONTAINERID=%s", env.ContainerID),
+		fmt.Sprintf("CNI_NETNS=%s", env.NetNS),
+		fmt.Sprintf("CNI_IFNAME=%s", ifName),
+		fmt.Sprintf("CNI_ARGS=%s", env.Args),
+		fmt.Sprintf("CNI_PATH=%s", env.Path),
+	)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("delegate %s %s failed: %v (%s)", meta.Type, command, err, stderr.String())
+	}
+
+	if command == "DEL" {
+		return nil, nil
+	}
+
+	var result CNIResult
+	if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+		return nil, fmt.Errorf("failed to parse result from delegate %s: %v", meta.Type, err)
+	}
+	return &result, nil
+}
+
+// mergeDelegateResult folds result, from one delegate invocation, into
+// aggregated: interfaces and routes are appended as-is, IP entries have
+// their Interface index rebased onto the aggregated interface list, and the
+// first delegate to return DNS wins.
+func mergeDelegateResult(aggregated, result *CNIResult) {
+	ifaceOffset := len(aggregated.Interfaces)
+	aggregated.Interfaces = append(aggregated.Interfaces, result.Interfaces...)
+	for _, ip := range result.IPs {
+		ip.Interface += ifaceOffset
+		aggregated.IPs = append(aggregated.IPs, ip)
+	}
+	aggregated.Routes = append(aggregated.Routes, result.Routes...)
+	if aggregated.DNS == nil {
+		aggregated.DNS = result.DNS
+	}
+}
+
+// addDelegates runs Add for every delegate in order, aggregating their
+// interfaces, IPs and routes into a single result. Each delegate runs on its
+// own ifName when its config sets one, otherwise on env.IfName. Every
+// delegate is handled the same way: routes from all of them are kept, and
+// the first delegate's routes are given no precedence over later ones.
+func addDelegates(config *NetworkConfig, env Env) (*CNIResult, error) {
+	aggregated := &CNIResult{CNIVersion: config.CNIVersion}
+
+	for i, raw := range config.Delegates {
+		result, err := execDelegate("ADD", env, raw)
+		if err != nil {
+			return nil, fmt.Errorf("delegate %d failed: %v", i, err)
+		}
+		mergeDelegateResult(aggregated, result)
+	}
+
+	if err := saveDelegateRecord(env.Path, env.ContainerID, config.Delegates); err != nil {
+		return nil, err
+	}
+
+	return aggregated, nil
+}
+
+// checkDelegates replays CHECK against every delegate in the stored record,
+// in the same order Add invoked them, aggregating results the way
+// addDelegates does.
+func checkDelegates(config *NetworkConfig, env Env, record *delegateRecord) (*CNIResult, error) {
+	aggregated := &CNIResult{CNIVersion: config.CNIVersion}
+
+	for i, raw := range record.Delegates {
+		result, err := execDelegate("CHECK", env, raw)
+		if err != nil {
+			return nil, fmt.Errorf("delegate %d failed: %v", i, err)
+		}
+		mergeDelegateResult(aggregated, result)
+	}
+
+	return aggregated, nil
+}
+
+// delDelegates tears delegates down in reverse order. Individual delegate
+// failures are collected rather than aborting so the rest of the chain
+// still gets a chance to clean up.
+func delDelegates(env Env, record *delegateRecord) error {
+	var errs []error
+	for i := len(record.Delegates) - 1; i >= 0; i-- {
+		if _, err := execDelegate("DEL", env, record.Delegates[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := removeDelegateRecord(env.Path, env.ContainerID); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("delegate cleanup had %d error(s): %v", len(errs), errs)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// withNetNSHandle runs fn with the calling goroutine's OS thread switched
+// into ns, restoring the original namespace afterwards. The switch is
+// thread-local, so the OS thread is locked for the duration.
+func withNetNSHandle(ns netns.NsHandle, fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNS, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get current network namespace: %v", err)
+	}
+	defer origNS.Close()
+
+	if err := netns.Set(ns); err != nil {
+		return fmt.Errorf("failed to enter network namespace: %v", err)
+	}
+	defer netns.Set(origNS)
+
+	return fn()
+}
+
+// withNetNS opens the namespace at nsPath and runs fn inside it. CNI_PID is
+// not populated by this plugin's getEnvironment, so entering by the
+// CNI_NETNS path (rather than netlink.LinkSetNsPid) is the reliable option.
+func withNetNS(nsPath string, fn func() error) error {
+	targetNS, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace %s: %v", nsPath, err)
+	}
+	defer targetNS.Close()
+
+	return withNetNSHandle(targetNS, fn)
+}
+
+// addrInNetNS looks up ifName inside the namespace at nsPath and returns its
+// first assigned IPv4 address.
+func addrInNetNS(nsPath, ifName string) (net.IP, error) {
+	var ip net.IP
+	err := withNetNS(nsPath, func() error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find %s in namespace: %v", ifName, err)
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return fmt.Errorf("failed to list addresses on %s: %v", ifName, err)
+		}
+		if len(addrs) == 0 {
+			return fmt.Errorf("no address assigned to %s", ifName)
+		}
+		ip = addrs[0].IP
+		return nil
+	})
+	return ip, err
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// TestWithNetNSHandleConfiguresLoopback exercises withNetNSHandle end to
+// end against an ephemeral network namespace. It needs
+// CAP_NET_ADMIN, so it skips itself when not running with enough privilege.
+func TestWithNetNSHandleConfiguresLoopback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("requires root to create a network namespace")
+	}
+
+	origNS, err := netns.Get()
+	if err != nil {
+		t.Fatalf("failed to get current network namespace: %v", err)
+	}
+	defer origNS.Close()
+	defer netns.Set(origNS)
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("failed to create ephemeral network namespace: %v", err)
+	}
+	defer ns.Close()
+
+	want := &net.IPNet{IP: net.IPv4(127, 0, 0, 2), Mask: net.CIDRMask(8, 32)}
+	if err := withNetNSHandle(ns, func() error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(lo, &netlink.Addr{IPNet: want}); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(lo)
+	}); err != nil {
+		t.Fatalf("withNetNSHandle: %v", err)
+	}
+
+	// netns.New switched this thread into the new namespace, and
+	// withNetNSHandle restores whatever namespace it found on entry, so put
+	// the thread back in the original namespace explicitly before asserting.
+	if err := netns.Set(origNS); err != nil {
+		t.Fatalf("failed to restore original namespace: %v", err)
+	}
+
+	var got net.IP
+	if err := withNetNSHandle(ns, func() error {
+		lo, err := netlink.LinkByName("lo")
+		if err != nil {
+			return err
+		}
+		addrs, err := netlink.AddrList(lo, netlink.FAMILY_V4)
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(want.IP) {
+				got = a.IP
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("withNetNSHandle: %v", err)
+	}
+
+	if got == nil || !got.Equal(want.IP) {
+		t.Fatalf("expected loopback to have address %s, got %v", want.IP, got)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import "encoding/json"
+
+// Method names understood by the daemon's JSON-RPC-over-UDS protocol.
+const (
+	MethodAdd     = "Add"
+	MethodDel     = "Del"
+	MethodCheck   = "Check"
+	MethodVersion = "Version"
+)
+
+// Request is one JSON-RPC-style call sent by cnishim over the Unix domain
+// socket. Config is left as raw JSON so the daemon can decode it against the
+// NetworkConfig it owns without the shim needing to understand its shape.
+type Request struct {
+	Method string          `json:"method"`
+	Env    Env             `json:"env,omitempty"`
+	Config json.RawMessage `json:"config,omitempty"`
+}
+
+// Response is returned by the daemon for every request. Exactly one of
+// Result/Error is set.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
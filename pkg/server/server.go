@@ -0,0 +1,700 @@
+// Package server implements cniserver, the long-running daemon behind
+// cnishim. It owns the IpPool, bridge, and veth setup in memory so repeated
+// ADD/DEL/CHECK calls don't pay the cost of reloading state from disk on
+// every invocation.
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/TheRealSibasishBehera/cni-basic/pkg"
+	"github.com/TheRealSibasishBehera/cni-basic/pkg/firewall"
+	"github.com/TheRealSibasishBehera/cni-basic/pkg/status"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Server is the cniserver daemon: a single process that owns the IpPool and
+// the bridge/veth state for one network, reached over a Unix domain socket.
+type Server struct {
+	SocketPath       string
+	CheckpointPeriod time.Duration
+
+	mutex    sync.Mutex
+	pool     *pkg.IpPool
+	listener net.Listener
+	wg       sync.WaitGroup
+	stopCh   chan struct{}
+}
+
+// New returns a Server listening on socketPath (DefaultSocketPath if empty).
+func New(socketPath string) *Server {
+	if socketPath == "" {
+		socketPath = DefaultSocketPath
+	}
+	return &Server{
+		SocketPath:       socketPath,
+		CheckpointPeriod: 30 * time.Second,
+		stopCh:           make(chan struct{}),
+	}
+}
+
+// ListenAndServe opens the Unix domain socket and serves requests until
+// Shutdown is called. It blocks until the listener is closed.
+func (s *Server) ListenAndServe() error {
+	if err := os.RemoveAll(s.SocketPath); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %v", s.SocketPath, err)
+	}
+
+	listener, err := net.Listen("unix", s.SocketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.SocketPath, err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.checkpointLoop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-s.stopCh:
+				return nil
+			default:
+				return fmt.Errorf("failed to accept connection: %v", err)
+			}
+		}
+		s.wg.Add(1)
+		go s.handleConn(conn)
+	}
+}
+
+// Shutdown stops accepting new connections, waits for in-flight requests and
+// the checkpoint loop to finish, flushes the pool to disk, and removes the
+// socket file.
+func (s *Server) Shutdown() error {
+	close(s.stopCh)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+
+	if err := s.savePool(); err != nil {
+		return err
+	}
+	return os.RemoveAll(s.SocketPath)
+}
+
+func (s *Server) checkpointLoop() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.CheckpointPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.savePool(); err != nil {
+				log.Printf("checkpoint: %v", err)
+			}
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *Server) savePool() error {
+	s.mutex.Lock()
+	pool := s.pool
+	s.mutex.Unlock()
+
+	if pool == nil {
+		return nil
+	}
+	return pool.Save()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("failed to decode request: %v", err)})
+		return
+	}
+
+	result, err := s.dispatch(req)
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: err.Error()})
+		return
+	}
+
+	raw, err := json.Marshal(result)
+	if err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("failed to marshal result: %v", err)})
+		return
+	}
+	json.NewEncoder(conn).Encode(Response{Result: raw})
+}
+
+func (s *Server) dispatch(req Request) (interface{}, error) {
+	switch req.Method {
+	case MethodVersion:
+		return s.Version(), nil
+	case MethodAdd:
+		return s.decodeAndRun(req, s.Add)
+	case MethodDel:
+		return s.decodeAndRun(req, s.Del)
+	case MethodCheck:
+		return s.decodeAndRun(req, s.Check)
+	default:
+		return nil, fmt.Errorf("unknown method %q", req.Method)
+	}
+}
+
+func (s *Server) decodeAndRun(req Request, handler func(*NetworkConfig, Env) (*CNIResult, error)) (*CNIResult, error) {
+	config, err := decodeConfig(req.Config)
+	if err != nil {
+		return nil, err
+	}
+	return handler(config, req.Env)
+}
+
+func decodeConfig(raw json.RawMessage) (*NetworkConfig, error) {
+	var config NetworkConfig
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	if config.Bridge == "" {
+		config.Bridge = "cni0"
+	}
+	if config.MTU == 0 {
+		config.MTU = DEFAULT_MTU
+	}
+	return &config, nil
+}
+
+// poolFor returns the in-memory IpPool for this network, creating or
+// loading it from disk exactly once rather than on every Add.
+func (s *Server) poolFor(config *NetworkConfig, env Env) (*pkg.IpPool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.pool != nil {
+		return s.pool, nil
+	}
+
+	cidrs := []string{config.Subnet}
+	if config.Subnet6 != "" {
+		cidrs = append(cidrs, config.Subnet6)
+	}
+	pool := pkg.NewIpPool(config.Bridge, cidrs, env.Path)
+	if err := pool.Load(); err != nil {
+		if err := pool.Save(); err != nil {
+			return nil, fmt.Errorf("failed to initialize IP pool: %v", err)
+		}
+	}
+	s.pool = pool
+	return pool, nil
+}
+
+// subnet pairs a parsed network with the gateway address inside it, so
+// dual-stack configs can be handled uniformly regardless of family.
+type subnet struct {
+	network *net.IPNet
+	gateway net.IP
+}
+
+// parseSubnets parses config.Subnet/Gateway (IPv4) and, if set,
+// config.Subnet6/Gateway6 (IPv6) into the subnets the pool hands addresses
+// out from.
+func parseSubnets(config *NetworkConfig) ([]subnet, error) {
+	var subnets []subnet
+
+	for _, pair := range [][2]string{{config.Subnet, config.Gateway}, {config.Subnet6, config.Gateway6}} {
+		cidr, gatewayStr := pair[0], pair[1]
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse subnet %s: %v", cidr, err)
+		}
+		gateway := net.ParseIP(gatewayStr)
+		if gateway == nil {
+			return nil, fmt.Errorf("invalid gateway IP %s", gatewayStr)
+		}
+		subnets = append(subnets, subnet{network: network, gateway: gateway})
+	}
+
+	return subnets, nil
+}
+
+// staticIPsFor collects any specific addresses requested for this
+// invocation: config.RuntimeConfig.IPs (the CNI 1.0 structured form) takes
+// precedence over a CNI_ARGS IP= hint when both are set.
+func staticIPsFor(config *NetworkConfig, cniArgs map[string]string) ([]net.IP, error) {
+	if config.RuntimeConfig != nil && len(config.RuntimeConfig.IPs) > 0 {
+		ips := make([]net.IP, 0, len(config.RuntimeConfig.IPs))
+		for _, ipStr := range config.RuntimeConfig.IPs {
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid runtimeConfig.ips entry %q", ipStr)
+			}
+			ips = append(ips, ip)
+		}
+		return ips, nil
+	}
+
+	if ipArg := cniArgs["IP"]; ipArg != "" {
+		ip := net.ParseIP(ipArg)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP in CNI_ARGS: %q", ipArg)
+		}
+		return []net.IP{ip}, nil
+	}
+
+	return nil, nil
+}
+
+func subnetFor(subnets []subnet, ip net.IP) (subnet, error) {
+	for _, s := range subnets {
+		if s.network.Contains(ip) {
+			return s, nil
+		}
+	}
+	return subnet{}, fmt.Errorf("IP %s does not belong to any configured subnet", ip)
+}
+
+func maskFor(subnets []subnet, ip net.IP) (net.IPMask, error) {
+	s, err := subnetFor(subnets, ip)
+	if err != nil {
+		return nil, err
+	}
+	return s.network.Mask, nil
+}
+
+// hasAddr reports whether link already carries addr. The daemon keeps the
+// bridge up across every ADD it serves, so a second (and any later)
+// container on the same network must not re-add the gateway address that's
+// already there.
+func hasAddr(link netlink.Link, addr *netlink.Addr) (bool, error) {
+	existing, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return false, fmt.Errorf("failed to list addresses on %s: %v", link.Attrs().Name, err)
+	}
+	for _, e := range existing {
+		if e.IPNet.String() == addr.IPNet.String() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Version handles the VERSION RPC.
+func (s *Server) Version() *VersionResult {
+	return &VersionResult{
+		CNIVersion:        "1.1.0",
+		SupportedVersions: []string{"0.4.0", "1.0.0", "1.1.0"},
+	}
+}
+
+// Add handles the Add RPC, setting up the bridge, veth pair and IP address
+// for a container, or delegating to embedded plugins when configured.
+func (s *Server) Add(config *NetworkConfig, env Env) (*CNIResult, error) {
+	cniArgs := parseCNIArgs(env.Args)
+	podNamespace, podName := cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"]
+	if podName != "" {
+		log.Printf("ADD command called for container %s (pod %s/%s)", env.ContainerID, podNamespace, podName)
+	} else {
+		log.Printf("ADD command called for container %s", env.ContainerID)
+	}
+
+	if len(config.Delegates) > 0 {
+		return addDelegates(config, env)
+	}
+
+	var bridge netlink.Link
+	var err error
+
+	pool, err := s.poolFor(config, env)
+	if err != nil {
+		return nil, err
+	}
+
+	store := status.NewStore(env.Path)
+	record, _ := store.Load(env.ContainerID)
+
+	if bridge, err = netlink.LinkByName(config.Bridge); err != nil {
+		link := &netlink.Bridge{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: config.Bridge,
+				MTU:  config.MTU,
+			},
+		}
+		if err := netlink.LinkAdd(link); err != nil {
+			return nil, fmt.Errorf("failed to create bridge %s: %v", config.Bridge, err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return nil, fmt.Errorf("failed to set up bridge %s: %v", config.Bridge, err)
+		}
+		bridge = link
+		log.Printf("Created bridge %s with MTU %d", config.Bridge, config.MTU)
+	}
+
+	containerID := env.ContainerID
+	strippedID := containerID
+	if len(strippedID) > 5 {
+		strippedID = strippedID[:5]
+	}
+	peerName := fmt.Sprintf("veth-%s", strippedID)
+
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: env.IfName,
+			MTU:  config.MTU,
+		},
+		PeerName: peerName,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, fmt.Errorf("failed to create veth pair: %v", err)
+	}
+
+	containerVeth, err := netlink.LinkByName(env.IfName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up veth %s: %v", env.IfName, err)
+	}
+
+	peerVeth, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peer veth %s: %v", peerName, err)
+	}
+	if err := netlink.LinkSetMaster(peerVeth, bridge); err != nil {
+		return nil, fmt.Errorf("failed to set master for peer veth %s: %v", peerName, err)
+	}
+	if err := netlink.LinkSetUp(peerVeth); err != nil {
+		return nil, fmt.Errorf("failed to set up peer veth %s: %v", peerName, err)
+	}
+
+	subnets, err := parseSubnets(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range subnets {
+		gatewayAddr := &netlink.Addr{
+			IPNet: &net.IPNet{IP: s.gateway, Mask: s.network.Mask},
+		}
+		exists, err := hasAddr(bridge, gatewayAddr)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		if err := netlink.AddrAdd(bridge, gatewayAddr); err != nil {
+			return nil, fmt.Errorf("failed to add gateway %s to bridge %s: %v", s.gateway, config.Bridge, err)
+		}
+	}
+
+	staticIPs, err := staticIPsFor(config, cniArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if record != nil && len(record.IPs) > 0 {
+		for _, ipStr := range record.IPs {
+			reused := net.ParseIP(ipStr)
+			if reused == nil {
+				continue
+			}
+			if err := pool.MarkAllocated(reused); err != nil {
+				return nil, fmt.Errorf("failed to reuse stored IP %s: %v", reused, err)
+			}
+			ips = append(ips, reused)
+		}
+	} else if len(staticIPs) > 0 {
+		for _, ip := range staticIPs {
+			if err := pool.AllocateSpecificIP(ip); err != nil {
+				return nil, fmt.Errorf("failed to allocate requested IP %s: %v", ip, err)
+			}
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		ips, err = pool.AllocateIP()
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate IP from pool: %v", err)
+		}
+	}
+
+	// Env carries no container PID, so the container veth is moved into
+	// place by namespace path (netlink.LinkSetNsFd) rather than
+	// netlink.LinkSetNsPid, and configured from inside that namespace.
+	targetNS, err := netns.GetFromPath(env.NetNS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open container network namespace %s: %v", env.NetNS, err)
+	}
+	defer targetNS.Close()
+
+	if err := netlink.LinkSetNsFd(containerVeth, int(targetNS)); err != nil {
+		return nil, fmt.Errorf("failed to move veth %s into container namespace: %v", env.IfName, err)
+	}
+
+	var containerMac string
+	err = withNetNSHandle(targetNS, func() error {
+		link, err := netlink.LinkByName(env.IfName)
+		if err != nil {
+			return fmt.Errorf("failed to find veth %s in container namespace: %v", env.IfName, err)
+		}
+
+		if record != nil && record.Mac != "" {
+			mac, err := net.ParseMAC(record.Mac)
+			if err != nil {
+				return fmt.Errorf("failed to parse stored MAC %s: %v", record.Mac, err)
+			}
+			if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+				return fmt.Errorf("failed to restore MAC %s on veth %s: %v", record.Mac, env.IfName, err)
+			}
+		} else if macArg := cniArgs["MAC"]; macArg != "" {
+			mac, err := net.ParseMAC(macArg)
+			if err != nil {
+				return fmt.Errorf("failed to parse MAC from CNI_ARGS: %v", err)
+			}
+			if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+				return fmt.Errorf("failed to set MAC %s on veth %s: %v", macArg, env.IfName, err)
+			}
+		}
+
+		for _, ip := range ips {
+			mask, err := maskFor(subnets, ip)
+			if err != nil {
+				return err
+			}
+			addr := &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: mask}}
+			if err := netlink.AddrAdd(link, addr); err != nil {
+				return fmt.Errorf("failed to add IP address %s to veth %s: %v", ip, env.IfName, err)
+			}
+		}
+
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("failed to set up veth %s: %v", env.IfName, err)
+		}
+
+		containerMac = link.Attrs().HardwareAddr.String()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ipStrs := make([]string, len(ips))
+	for i, ip := range ips {
+		ipStrs[i] = ip.String()
+	}
+	if err := store.Save(&status.Record{
+		ContainerID:  env.ContainerID,
+		IPs:          ipStrs,
+		Mac:          containerMac,
+		IfName:       env.IfName,
+		PeerName:     peerName,
+		Bridge:       config.Bridge,
+		NetNS:        env.NetNS,
+		PodNamespace: podNamespace,
+		PodName:      podName,
+	}); err != nil {
+		return nil, err
+	}
+
+	// A record means this container already held a slot in the network's
+	// firewall refcount from its first ADD; replaying its reload here must
+	// not bump that count a second time, or the matching DEL's Teardown
+	// will never bring it back to zero.
+	if record == nil {
+		if err := firewall.Setup(firewallConfigFor(config, env)); err != nil {
+			return nil, fmt.Errorf("failed to install firewall rules: %v", err)
+		}
+	}
+
+	result := &CNIResult{
+		CNIVersion: config.CNIVersion,
+		Interfaces: []CNIInterface{
+			{Name: config.Bridge, Mac: bridge.Attrs().HardwareAddr.String()},
+			{Name: env.IfName, Mac: containerMac, Sandbox: env.NetNS},
+		},
+		DNS: &DNS{Nameservers: []string{"8.8.8.8", "1.1.1.1"}},
+	}
+	for _, ip := range ips {
+		sub, err := subnetFor(subnets, ip)
+		if err != nil {
+			return nil, err
+		}
+		ones, _ := sub.network.Mask.Size()
+		result.IPs = append(result.IPs, CNIIP{
+			Interface: 1,
+			Address:   fmt.Sprintf("%s/%d", ip, ones),
+			Gateway:   sub.gateway.String(),
+		})
+	}
+
+	return result, nil
+}
+
+// Del handles the Del RPC: it enters env.NetNS to read the address assigned
+// to env.IfName, deletes the peer veth in the host namespace, and releases
+// the address back to the IP pool.
+func (s *Server) Del(config *NetworkConfig, env Env) (*CNIResult, error) {
+	if record, err := loadDelegateRecord(env.Path, env.ContainerID); err == nil {
+		log.Printf("DEL command called for container %s", env.ContainerID)
+		return nil, delDelegates(env, record)
+	}
+
+	store := status.NewStore(env.Path)
+	record, _ := store.Load(env.ContainerID)
+
+	cniArgs := parseCNIArgs(env.Args)
+	podNamespace, podName := cniArgs["K8S_POD_NAMESPACE"], cniArgs["K8S_POD_NAME"]
+	if podName == "" && record != nil {
+		podNamespace, podName = record.PodNamespace, record.PodName
+	}
+	if podName != "" {
+		log.Printf("DEL command called for container %s (pod %s/%s)", env.ContainerID, podNamespace, podName)
+	} else {
+		log.Printf("DEL command called for container %s", env.ContainerID)
+	}
+
+	ip, err := addrInNetNS(env.NetNS, env.IfName)
+	if err != nil {
+		log.Printf("DEL: failed to read address of %s in %s, falling back to status store: %v", env.IfName, env.NetNS, err)
+		if record != nil && len(record.IPs) > 0 {
+			ip = net.ParseIP(record.IPs[0])
+		}
+	}
+
+	strippedID := env.ContainerID
+	if len(strippedID) > 5 {
+		strippedID = strippedID[:5]
+	}
+	peerName := fmt.Sprintf("veth-%s", strippedID)
+	if record != nil && record.PeerName != "" {
+		peerName = record.PeerName
+	}
+
+	if link, err := netlink.LinkByName(peerName); err == nil {
+		if err := netlink.LinkDel(link); err != nil {
+			return nil, fmt.Errorf("failed to delete peer veth %s: %v", peerName, err)
+		}
+	}
+
+	released := map[string]bool{}
+	if ip != nil {
+		if err := s.releaseIP(config, env, ip); err != nil {
+			return nil, err
+		}
+		released[ip.String()] = true
+	}
+	if record != nil {
+		for _, ipStr := range record.IPs {
+			if released[ipStr] {
+				continue
+			}
+			if other := net.ParseIP(ipStr); other != nil {
+				if err := s.releaseIP(config, env, other); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if record != nil {
+		if err := store.Remove(env.ContainerID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only a container with a status record holds a firewall refcount slot,
+	// so a repeated DEL for a container already torn down leaves it alone.
+	if record != nil {
+		if err := firewall.Teardown(firewallConfigFor(config, env)); err != nil {
+			return nil, fmt.Errorf("failed to remove firewall rules: %v", err)
+		}
+	}
+
+	return nil, nil
+}
+
+// firewallConfigFor derives the firewall package's per-network config from
+// the CNI network config, keeping the refcount file next to the IP pool.
+func firewallConfigFor(config *NetworkConfig, env Env) firewall.Config {
+	return firewall.Config{
+		Bridge: config.Bridge,
+		CIDR:   config.Subnet,
+		IPMasq: config.IPMasq,
+		ICC:    !config.ICCDisabled,
+		Path:   env.Path,
+	}
+}
+
+// releaseIP returns ip to the pool and persists the pool immediately, so a
+// released address isn't silently lost if the daemon restarts before the
+// next checkpoint.
+func (s *Server) releaseIP(config *NetworkConfig, env Env, ip net.IP) error {
+	pool, err := s.poolFor(config, env)
+	if err != nil {
+		return err
+	}
+	if err := pool.ReleaseIP(ip); err != nil {
+		return fmt.Errorf("failed to release IP %s: %v", ip, err)
+	}
+	return pool.Save()
+}
+
+// Check handles the Check RPC. For a meta-plugin container it replays
+// CHECK through the stored delegate chain; otherwise it reports the
+// IP/MAC/ifname actually recorded for this container at ADD time rather
+// than fabricated values.
+func (s *Server) Check(config *NetworkConfig, env Env) (*CNIResult, error) {
+	log.Printf("CHECK command called for container %s", env.ContainerID)
+
+	if record, err := loadDelegateRecord(env.Path, env.ContainerID); err == nil {
+		return checkDelegates(config, env, record)
+	}
+
+	store := status.NewStore(env.Path)
+	record, err := store.Load(env.ContainerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load status for container %s: %v", env.ContainerID, err)
+	}
+
+	subnets, err := parseSubnets(config)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CNIResult{
+		CNIVersion: config.CNIVersion,
+		Interfaces: []CNIInterface{
+			{Name: record.IfName, Mac: record.Mac, Sandbox: env.NetNS},
+		},
+	}
+	for _, ipStr := range record.IPs {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		gateway := ""
+		if sub, err := subnetFor(subnets, ip); err == nil {
+			gateway = sub.gateway.String()
+		}
+		result.IPs = append(result.IPs, CNIIP{Interface: 0, Address: ipStr, Gateway: gateway})
+	}
+	return result, nil
+}
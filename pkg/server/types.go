@@ -0,0 +1,89 @@
+package server
+
+import "encoding/json"
+
+// DEFAULT_MTU is the default MTU for the bridge interface.
+const DEFAULT_MTU = 1500
+
+// NetworkConfig represents the CNI network configuration.
+type NetworkConfig struct {
+	CNIVersion string `json:"cniVersion"`
+	Bridge     string `json:"bridge,omitempty"`
+	Subnet     string `json:"subnet,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
+	// Subnet6/Gateway6 add an IPv6 range to the pool alongside Subnet, for
+	// dual-stack containers.
+	Subnet6  string `json:"subnet6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	MTU      int    `json:"mtu,omitempty"`
+	IPMasq   bool   `json:"ipMasq,omitempty"`
+	// ICCDisabled drops forwarded traffic between two containers on the
+	// same bridge; inter-container communication is allowed by default.
+	ICCDisabled bool `json:"iccDisabled,omitempty"`
+	DNS         *DNS `json:"dns,omitempty"`
+
+	// Delegates, when set, turns ADD/DEL into a Multus-style meta-plugin
+	// call chain: each embedded config is execed as its own CNI_PATH binary
+	// instead of being handled by this server directly.
+	Delegates []json.RawMessage `json:"delegates,omitempty"`
+
+	// RuntimeConfig carries the CNI 1.0 runtimeConfig object, the
+	// structured alternative to a CNI_ARGS IP= hint for requesting a
+	// static address.
+	RuntimeConfig *RuntimeConfig `json:"runtimeConfig,omitempty"`
+}
+
+// RuntimeConfig holds the per-invocation runtime hints a container runtime
+// can pass alongside the static NetworkConfig.
+type RuntimeConfig struct {
+	IPs []string `json:"ips,omitempty"`
+}
+
+type DNS struct {
+	Nameservers []string `json:"nameservers,omitempty"`
+}
+
+// CNIResult represents the result returned by the ADD/CHECK commands.
+type CNIResult struct {
+	CNIVersion string         `json:"cniVersion"`
+	Interfaces []CNIInterface `json:"interfaces,omitempty"`
+	IPs        []CNIIP        `json:"ips,omitempty"`
+	Routes     []CNIRoute     `json:"routes,omitempty"`
+	DNS        *DNS           `json:"dns,omitempty"`
+}
+
+// CNIInterface represents a network interface.
+type CNIInterface struct {
+	Name    string `json:"name"`
+	Mac     string `json:"mac,omitempty"`
+	Sandbox string `json:"sandbox,omitempty"`
+}
+
+// CNIIP represents an IP assignment.
+type CNIIP struct {
+	Interface int    `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+}
+
+// CNIRoute represents a route to be added inside the container namespace.
+type CNIRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// VersionResult represents the VERSION command response.
+type VersionResult struct {
+	CNIVersion        string   `json:"cniVersion"`
+	SupportedVersions []string `json:"supportedVersions"`
+}
+
+// Env mirrors the CNI_* environment variables the shim read for a single
+// invocation, carried over the wire instead of re-read from os.Getenv.
+type Env struct {
+	ContainerID string `json:"container_id"`
+	NetNS       string `json:"netns"`
+	IfName      string `json:"if_name"`
+	Args        string `json:"args"`
+	Path        string `json:"path"`
+}
@@ -0,0 +1,94 @@
+// Package status records, per container, the network state cniserver
+// assigned at ADD time so it can be replayed: on DEL to know what to tear
+// down, and on daemon restart to rebuild the bridge/veth while keeping the
+// container's IP and MAC stable.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Record is the network state assigned to a single container.
+type Record struct {
+	ContainerID string   `json:"container_id"`
+	IPs         []string `json:"ips"`
+	Mac         string   `json:"mac,omitempty"`
+	IfName      string   `json:"if_name"`
+	PeerName    string   `json:"peer_name"`
+	Bridge      string   `json:"bridge"`
+	NetNS       string   `json:"netns"`
+
+	// PodNamespace/PodName, when the runtime passed them via CNI_ARGS,
+	// identify the workload this record belongs to for logging.
+	PodNamespace string `json:"pod_namespace,omitempty"`
+	PodName      string `json:"pod_name,omitempty"`
+}
+
+// Store persists Records as one file per container, next to the IpPool's
+// own JSON file.
+type Store struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+// NewStore returns a Store that keeps its records under path.
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+func (s *Store) recordPath(containerID string) string {
+	return filepath.Join(s.Path, fmt.Sprintf("status-%s.json", containerID))
+}
+
+// Save writes record atomically, keyed by its ContainerID.
+func (s *Store) Save(record *Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal status record: %v", err)
+	}
+
+	final := s.recordPath(record.ContainerID)
+	tmp := final + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write status record: %v", err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		return fmt.Errorf("failed to commit status record: %v", err)
+	}
+	return nil
+}
+
+// Load returns the record for containerID, or an error if none exists.
+func (s *Store) Load(containerID string) (*Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := os.ReadFile(s.recordPath(containerID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status record: %v", err)
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal status record: %v", err)
+	}
+	return &record, nil
+}
+
+// Remove deletes the record for containerID, if present.
+func (s *Store) Remove(containerID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.Remove(s.recordPath(containerID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove status record: %v", err)
+	}
+	return nil
+}